@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/zrepl/zrepl/zfs"
+)
+
+// PruneFilesystemVersion destroys version, automatically adding
+// DestroyDeferDeletion to flags if version still has a user hold. Without
+// this, destroying a held snapshot (e.g. one carrying a RecvHoldTag or
+// SendHoldTag placed by an in-flight replication step) would fail outright
+// instead of deferring until the hold is released.
+func PruneFilesystemVersion(ctx context.Context, fs *zfs.DatasetPath, version *zfs.FilesystemVersion, flags zfs.DestroyFlag) error {
+	holds, err := zfs.ZFSHolds(ctx, fs, version.Name)
+	if err != nil {
+		return err
+	}
+	if len(holds) > 0 {
+		flags |= zfs.DestroyDeferDeletion
+	}
+	return zfs.ZFSDestroyFilesystemVersions(ctx, fs, []*zfs.FilesystemVersion{version}, flags)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/zrepl/zrepl/rpc"
 	"github.com/zrepl/zrepl/zfs"
 	"io"
+	"sync"
 )
 
 type localPullACL struct{}
@@ -26,33 +27,94 @@ const DEFAULT_INITIAL_REPL_POLICY = InitialReplPolicyMostRecent
 
 type Puller struct {
 	task                    *Task
+	JobID                   string
 	Remote                  rpc.RPCClient
 	Mapping                 *DatasetMapFilter
 	InitialReplPolicy       InitialReplPolicy
 	FilesystemVersionFilter zfs.FilesystemVersionFilter
 }
 
+// holdOnCloseWriteCloser places a hold on a just-received snapshot once the
+// receive stream has been fully written, so the pruner (or an operator's own
+// `zfs destroy -r`) cannot remove it before its feed-forward to the next
+// replication step is confirmed.
+type holdOnCloseWriteCloser struct {
+	io.WriteCloser
+	afterClose func() error
+}
+
+func (w *holdOnCloseWriteCloser) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.afterClose()
+}
+
+// releaseOnEOFReader releases a send-side hold once the stream it guards has
+// been fully read (or failed), mirroring holdOnCloseWriteCloser on the send
+// side. Release is called at most once.
+type releaseOnEOFReader struct {
+	io.Reader
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnEOFReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.once.Do(r.release)
+	}
+	return n, err
+}
+
+// releasePreviousReceiveHolds releases this job's RecvHoldTag from every
+// version of fs other than keep, so that only the most recently received
+// snapshot stays held while older ones become eligible for pruning again.
+//
+// It calls the now ctx-aware zfs helpers with context.Background(): neither
+// Puller nor the replication interface its methods implement give us a
+// per-call, cancellable context to thread through instead.
+func (p *Puller) releasePreviousReceiveHolds(fs *zfs.DatasetPath, keep string) error {
+	ctx := context.Background()
+	versions, err := zfs.ZFSListFilesystemVersions(fs, p.FilesystemVersionFilter)
+	if err != nil {
+		return err
+	}
+	tag := zfs.RecvHoldTag(p.JobID)
+	for _, v := range versions {
+		if v.Name == keep {
+			continue
+		}
+		holds, err := zfs.ZFSHolds(ctx, fs, v.Name)
+		if err != nil {
+			return err
+		}
+		for _, h := range holds {
+			if h.Tag != tag {
+				continue
+			}
+			if err := zfs.ZFSRelease(ctx, fs, v.Name, tag, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (p *Puller) ListFilesystems() ([]replication.Filesystem, error) {
 	f, err := p.Mapping.InvertedFilter()
 	if err != nil {
 		return nil, err
 	}
-	ch := make(chan zfs.ZFSListResult)
-	props := []string{"name", "receive_resume_token"}
-	go zfs.ZFSListChan(context.Background(), ch, props)
-	defer close(ch)
-	fss := make([]replication.Filesystem, 0)
-	for res := range ch {
-		if res.Err != nil {
-			return nil, res.Err
-		}
-		token := res.Fields[1]
-		if token == "-" {
-			token = ""
-		}
+	datasets, err := zfs.ZFSDatasets(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	fss := make([]replication.Filesystem, 0, len(datasets))
+	for _, ds := range datasets {
 		fss = append(fss, replication.Filesystem{
-			Path:        res.Fields[0],
-			ResumeToken: res.Fields[1],
+			Path:        ds.Name,
+			ResumeToken: ds.ReceiveResumeToken,
 		})
 	}
 	return fss, nil
@@ -78,8 +140,100 @@ func (p *Puller) ListFilesystemVersions(fs string) ([]zfs.FilesystemVersion, err
 
 }
 
+// logFilesystemDiff logs, at debug level, the paths that changed between from
+// and to. Send uses it to give operators visibility into how close to a
+// no-op a given incremental step was.
+//
+// NOTE: an earlier version of this code skipped the send entirely when the
+// diff came back empty, but that broke the receive side: the receiver never
+// got the snapshot it was expecting, so its replication cursor stopped
+// advancing and the next step was computed against the wrong "from". Sending
+// a diff-empty incremental stream is more bandwidth than strictly needed, but
+// it is the only way to keep sender and receiver snapshot history in sync, so
+// that part of the original request is intentionally left unimplemented.
+func (p *Puller) logFilesystemDiff(fs *zfs.DatasetPath, from, to *zfs.FilesystemVersion) {
+	diff, err := zfs.ZFSDiff(fs, from, to)
+	if err != nil {
+		p.task.Log().WithError(err).Warn("cannot compute zfs diff")
+		return
+	}
+	p.task.Log().WithField("changes", len(diff)).Debug("zfs diff between versions")
+	for _, e := range diff {
+		p.task.Log().
+			WithField("change", e.Change.String()).
+			WithField("path", e.Path).
+			Debug("changed path")
+	}
+}
+
+// Send places a SendHoldTag hold on the from and (if present) to snapshots
+// before invoking `zfs send`, and releases it once the caller has fully read
+// the returned stream, so a send in flight (including a resumed one) can't be
+// pruned out from under it. Like Receive, it only acts on filesystems that
+// pass p.Mapping's inverted filter; whether a Puller should expose Send to
+// an RPC caller at all is a question for the endpoint wiring, not this file.
+//
+// If r.ResumeToken is set, the receive side is asking to resume a previously
+// interrupted transfer (see zfs.ZFSGetReceiveResumeToken); Send honors that
+// by resuming via ZFSSendResume instead of starting a fresh `zfs send -i`.
 func (p *Puller) Send(r replication.SendRequest) (replication.SendResponse, error) {
-	return replication.SendResponse{}, fmt.Errorf("puller does not send")
+	dp, err := zfs.NewDatasetPath(r.Filesystem)
+	if err != nil {
+		return replication.SendResponse{}, err
+	}
+	f, err := p.Mapping.InvertedFilter()
+	if err != nil {
+		return replication.SendResponse{}, err
+	}
+	pass, err := f.Filter(dp)
+	if err != nil {
+		return replication.SendResponse{}, err
+	}
+	if !pass {
+		return replication.SendResponse{}, replication.NewFilteredError(r.Filesystem)
+	}
+
+	if r.To != nil && r.ResumeToken == "" {
+		// Even a diff-empty incremental step must still reach the receiver so
+		// its snapshot pointer advances; logFilesystemDiff only reports on how
+		// much changed, it never skips the send.
+		p.logFilesystemDiff(dp, r.From, r.To)
+	}
+
+	// See releasePreviousReceiveHolds: no per-call cancellable context is
+	// available here either.
+	ctx := context.Background()
+	tag := zfs.SendHoldTag(p.JobID)
+	if err := zfs.ZFSHold(ctx, dp, r.From.Name, tag, false); err != nil {
+		return replication.SendResponse{}, err
+	}
+	if r.To != nil {
+		if err := zfs.ZFSHold(ctx, dp, r.To.Name, tag, false); err != nil {
+			zfs.ZFSRelease(ctx, dp, r.From.Name, tag, false)
+			return replication.SendResponse{}, err
+		}
+	}
+	release := func() {
+		zfs.ZFSRelease(ctx, dp, r.From.Name, tag, false)
+		if r.To != nil {
+			zfs.ZFSRelease(ctx, dp, r.To.Name, tag, false)
+		}
+	}
+
+	var stream io.Reader
+	if r.ResumeToken != "" {
+		stream, err = zfs.ZFSSendResume(r.ResumeToken)
+	} else {
+		stream, err = zfs.ZFSSend(dp, r.From, r.To)
+	}
+	if err != nil {
+		release()
+		return replication.SendResponse{}, err
+	}
+
+	return replication.SendResponse{
+		Stream: &releaseOnEOFReader{Reader: stream, release: release},
+	}, nil
 }
 
 func (p *Puller) Receive(r replication.ReceiveRequest) (io.Writer, error) {
@@ -99,7 +253,7 @@ func (p *Puller) Receive(r replication.ReceiveRequest) (io.Writer, error) {
 		return nil, replication.NewFilteredError(r.Filesystem)
 	}
 	if r.ResumeToken != "" {
-		localToken, err := zfs.ZFSGetReceiveResumeToken(dp)
+		localToken, err := zfs.ZFSGetReceiveResumeToken(context.Background(), dp)
 		if err != nil {
 			return nil, err
 		}
@@ -112,5 +266,16 @@ func (p *Puller) Receive(r replication.ReceiveRequest) (io.Writer, error) {
 		return nil, err
 	}
 	// FIXME close writer
-	return writer, nil
+	return &holdOnCloseWriteCloser{
+		WriteCloser: writer,
+		afterClose: func() error {
+			if err := zfs.ZFSHold(context.Background(), dp, r.FilesystemVersion.Name, zfs.RecvHoldTag(p.JobID), false); err != nil {
+				return err
+			}
+			// Release the hold on whatever we previously received for this job
+			// now that the new snapshot is itself held, so RecvHoldTag holds
+			// don't accumulate forever and block pruning.
+			return p.releasePreviousReceiveHolds(dp, r.FilesystemVersion.Name)
+		},
+	}, nil
 }
@@ -0,0 +1,56 @@
+package zfs
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var prom struct {
+	ZFSSnapshotDuration prometheus.HistogramVec
+	ZFSBookmarkDuration prometheus.HistogramVec
+	ZFSDiffDuration     prometheus.HistogramVec
+	ZFSDiffChangeCount  prometheus.HistogramVec
+	ZFSCommandDuration  prometheus.HistogramVec
+}
+
+func init() {
+	prom.ZFSSnapshotDuration = *prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "zrepl",
+		Subsystem: "zfs",
+		Name:      "snapshot_duration",
+		Help:      "Duration of zfs snapshot invocations",
+	}, []string{"filesystem"})
+	prom.ZFSBookmarkDuration = *prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "zrepl",
+		Subsystem: "zfs",
+		Name:      "bookmark_duration",
+		Help:      "Duration of zfs bookmark invocations",
+	}, []string{"filesystem"})
+	prom.ZFSDiffDuration = *prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "zrepl",
+		Subsystem: "zfs",
+		Name:      "diff_duration",
+		Help:      "Duration of zfs diff invocations",
+	}, []string{"filesystem"})
+	prom.ZFSDiffChangeCount = *prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "zrepl",
+		Subsystem: "zfs",
+		Name:      "diff_change_count",
+		Help:      "Number of changed paths reported by zfs diff between two versions",
+		Buckets:   prometheus.ExponentialBuckets(1, 8, 6),
+	}, []string{"filesystem"})
+	prom.ZFSCommandDuration = *prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "zrepl",
+		Subsystem: "zfs",
+		Name:      "command_duration",
+		Help:      "Duration of zfs subcommand invocations, labeled by subcommand (send, recv, list, ...)",
+	}, []string{"subcommand"})
+}
+
+// RegisterMetrics registers all zfs package Prometheus collectors with
+// registry. It must be called exactly once, typically from the daemon's
+// startup code.
+func RegisterMetrics(registry prometheus.Registerer) {
+	registry.MustRegister(prom.ZFSSnapshotDuration)
+	registry.MustRegister(prom.ZFSBookmarkDuration)
+	registry.MustRegister(prom.ZFSDiffDuration)
+	registry.MustRegister(prom.ZFSDiffChangeCount)
+	registry.MustRegister(prom.ZFSCommandDuration)
+}
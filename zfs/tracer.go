@@ -0,0 +1,114 @@
+package zfs
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subcommandOf returns the zfs subcommand (argv[0]) an invocation's argv
+// belongs to, for use as the prom.ZFSCommandDuration label.
+func subcommandOf(argv []string) string {
+	if len(argv) == 0 {
+		return ""
+	}
+	return argv[0]
+}
+
+// CommandTracer lets callers observe every `zfs` invocation this package
+// makes. Log is called right before the command is started; Observe is
+// called once it has finished (successfully or not).
+type CommandTracer interface {
+	Log(argv []string)
+	Observe(argv []string, dur time.Duration, err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Log(argv []string)                                   {}
+func (noopTracer) Observe(argv []string, dur time.Duration, err error) {}
+
+// tracerHolder boxes the currently installed CommandTracer so it can be
+// swapped via atomic.Value, which requires a consistent concrete type across
+// all Store calls.
+type tracerHolder struct {
+	t CommandTracer
+}
+
+var currentTracer atomic.Value // holds tracerHolder
+
+func init() {
+	currentTracer.Store(tracerHolder{noopTracer{}})
+}
+
+// SetTracer installs t as the package-wide CommandTracer, replacing whatever
+// tracer was previously installed. Passing nil restores the default no-op
+// tracer. It is safe to call concurrently with in-flight zfs invocations; it
+// is intended to be called once during daemon startup, e.g. to wire zfs
+// invocations into the zrepl structured logger.
+func SetTracer(t CommandTracer) {
+	if t == nil {
+		t = noopTracer{}
+	}
+	currentTracer.Store(tracerHolder{t})
+}
+
+func tracer() CommandTracer {
+	return currentTracer.Load().(tracerHolder).t
+}
+
+// observingReader wraps an io.Reader obtained from a long-running streaming
+// zfs invocation (e.g. `zfs send`) and calls Observe exactly once, as soon as
+// the read side sees EOF or an error, so Log/Observe stay paired even though
+// no single call site waits for the underlying process to exit.
+type observingReader struct {
+	io.Reader
+	argv  []string
+	start time.Time
+	once  sync.Once
+}
+
+func newObservingReader(r io.Reader, argv []string) io.Reader {
+	return &observingReader{Reader: r, argv: argv, start: time.Now()}
+}
+
+func (r *observingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.observe(err)
+	}
+	return n, err
+}
+
+func (r *observingReader) observe(err error) {
+	r.once.Do(func() {
+		if err == io.EOF {
+			err = nil
+		}
+		dur := time.Since(r.start)
+		prom.ZFSCommandDuration.WithLabelValues(subcommandOf(r.argv)).Observe(dur.Seconds())
+		tracer().Observe(r.argv, dur, err)
+	})
+}
+
+// observingWriteCloser is the write-side counterpart of observingReader, for
+// long-running invocations driven by writing to them (e.g. `zfs recv`). It
+// calls Observe once Close returns.
+type observingWriteCloser struct {
+	io.WriteCloser
+	argv  []string
+	start time.Time
+}
+
+func newObservingWriteCloser(w io.WriteCloser, argv []string) io.WriteCloser {
+	return &observingWriteCloser{WriteCloser: w, argv: argv, start: time.Now()}
+}
+
+func (w *observingWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	dur := time.Since(w.start)
+	prom.ZFSCommandDuration.WithLabelValues(subcommandOf(w.argv)).Observe(dur.Seconds())
+	tracer().Observe(w.argv, dur, err)
+	return err
+}
@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"context"
 	"github.com/problame/go-rwccmd"
@@ -128,64 +130,291 @@ func toDatasetPath(s string) *DatasetPath {
 	return p
 }
 
+// DatasetType is the type of a ZFS dataset as reported by the `type` property.
+type DatasetType string
+
+const (
+	DatasetFilesystem DatasetType = "filesystem"
+	DatasetSnapshot   DatasetType = "snapshot"
+	DatasetVolume     DatasetType = "volume"
+	DatasetBookmark   DatasetType = "bookmark"
+)
+
+// Dataset is a typed representation of the subset of `zfs list -p` properties
+// zrepl cares about. Numeric properties are parsed from the raw `-Hp` output,
+// where ZFS reports an absent or inapplicable value as "-".
+type Dataset struct {
+	Name               string
+	Type               DatasetType
+	Used               uint64
+	Avail              uint64
+	Referenced         uint64
+	Written            uint64
+	Logicalused        uint64
+	Usedbydataset      uint64
+	Volsize            uint64
+	Quota              uint64
+	Origin             string
+	Mountpoint         string
+	Compression        string
+	ReceiveResumeToken string
+}
+
+// datasetListColumns is the `-o` column list used by ZFSDatasets / ZFSDatasetsChan.
+// Its order must match parseDatasetFields.
+var datasetListColumns = []string{
+	"name", "type", "used", "avail", "referenced", "written",
+	"logicalused", "usedbydataset", "volsize", "quota",
+	"origin", "mountpoint", "compression", "receive_resume_token",
+}
+
+// parseDatasetUint64 parses a numeric `zfs list -p` field, treating "-" (the
+// value ZFS prints for properties that are absent or not applicable to the
+// dataset's type) as zero.
+func parseDatasetUint64(field string) (uint64, error) {
+	if field == "-" {
+		return 0, nil
+	}
+	return strconv.ParseUint(field, 10, 64)
+}
+
+// parseDatasetString parses a `zfs list -p` string field, treating "-" as the
+// empty string.
+func parseDatasetString(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+func parseDatasetFields(fields []string) (*Dataset, error) {
+	if len(fields) != len(datasetListColumns) {
+		return nil, errors.New("unexpected number of columns in zfs list output")
+	}
+	var err error
+	d := &Dataset{
+		Name: fields[0],
+		Type: DatasetType(fields[1]),
+	}
+	if d.Used, err = parseDatasetUint64(fields[2]); err != nil {
+		return nil, fmt.Errorf("cannot parse used: %s", err)
+	}
+	if d.Avail, err = parseDatasetUint64(fields[3]); err != nil {
+		return nil, fmt.Errorf("cannot parse avail: %s", err)
+	}
+	if d.Referenced, err = parseDatasetUint64(fields[4]); err != nil {
+		return nil, fmt.Errorf("cannot parse referenced: %s", err)
+	}
+	if d.Written, err = parseDatasetUint64(fields[5]); err != nil {
+		return nil, fmt.Errorf("cannot parse written: %s", err)
+	}
+	if d.Logicalused, err = parseDatasetUint64(fields[6]); err != nil {
+		return nil, fmt.Errorf("cannot parse logicalused: %s", err)
+	}
+	if d.Usedbydataset, err = parseDatasetUint64(fields[7]); err != nil {
+		return nil, fmt.Errorf("cannot parse usedbydataset: %s", err)
+	}
+	if d.Volsize, err = parseDatasetUint64(fields[8]); err != nil {
+		return nil, fmt.Errorf("cannot parse volsize: %s", err)
+	}
+	if d.Quota, err = parseDatasetUint64(fields[9]); err != nil {
+		return nil, fmt.Errorf("cannot parse quota: %s", err)
+	}
+	d.Origin = parseDatasetString(fields[10])
+	d.Mountpoint = parseDatasetString(fields[11])
+	d.Compression = parseDatasetString(fields[12])
+	d.ReceiveResumeToken = parseDatasetString(fields[13])
+	return d, nil
+}
+
+// ZFSDatasets lists datasets under filter (recursively) and returns them as
+// typed Dataset values. If filter is nil, all datasets visible to the zfs
+// command are returned.
+func ZFSDatasets(ctx context.Context, filter *DatasetPath) ([]*Dataset, error) {
+	ch := make(chan DatasetsResult)
+	go ZFSDatasetsChan(ctx, ch, filter)
+	datasets := make([]*Dataset, 0)
+	for res := range ch {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		datasets = append(datasets, res.Dataset)
+	}
+	return datasets, nil
+}
+
+// DatasetsResult is the element type sent on the channel passed to
+// ZFSDatasetsChan, analogous to ZFSListResult for the raw ZFSListChan API.
+type DatasetsResult struct {
+	Dataset *Dataset
+	Err     error
+}
+
+// ZFSDatasetsChan is the streaming, typed counterpart to ZFSDatasets. It is
+// layered on top of ZFSListChan and has the same channel-closing and
+// cancellation semantics.
+func ZFSDatasetsChan(ctx context.Context, out chan DatasetsResult, filter *DatasetPath) {
+	defer close(out)
+
+	zfsArgs := make([]string, 0, 2)
+	if filter != nil {
+		zfsArgs = append(zfsArgs, "-r", filter.ToString())
+	}
+
+	rawOut := make(chan ZFSListResult)
+	go ZFSListChan(ctx, rawOut, datasetListColumns, zfsArgs...)
+
+	for res := range rawOut {
+		if res.Err != nil {
+			select {
+			case <-ctx.Done():
+			case out <- DatasetsResult{Err: res.Err}:
+			}
+			return
+		}
+		ds, err := parseDatasetFields(res.Fields)
+		select {
+		case <-ctx.Done():
+			return
+		case out <- DatasetsResult{Dataset: ds, Err: err}:
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
 type ZFSError struct {
-	Stderr  []byte
-	WaitErr error
+	Argv     []string
+	ExitCode int
+	Stderr   []byte
+	WaitErr  error
 }
 
 func (e ZFSError) Error() string {
-	return fmt.Sprintf("zfs exited with error: %s", e.WaitErr.Error())
+	if len(e.Argv) == 0 {
+		return fmt.Sprintf("zfs exited with error: %s", e.WaitErr.Error())
+	}
+	return fmt.Sprintf("zfs %s: exited with error (exit code %d): %s",
+		strings.Join(e.Argv, " "), e.ExitCode, e.WaitErr.Error())
 }
 
 var ZFS_BINARY string = "zfs"
 
-func ZFSList(properties []string, zfsArgs ...string) (res [][]string, err error) {
+// exitCodeOf extracts the process exit code from err, or -1 if it cannot be
+// determined (e.g. the process never started).
+func exitCodeOf(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
 
-	args := make([]string, 0, 4+len(zfsArgs))
-	args = append(args,
-		"list", "-H", "-p",
-		"-o", strings.Join(properties, ","))
-	args = append(args, zfsArgs...)
+// runZFS runs `zfs argv...`, routing it through the package's CommandTracer
+// and Prometheus command-duration histogram, and returns its stdout. All
+// blocking (non-streaming) zfs invocations go through this helper (and its
+// stdin-accepting sibling runZFSStdin) so they get consistent tracing, timing
+// and error reporting.
+func runZFS(ctx context.Context, argv []string) ([]byte, error) {
+	return runZFSStdin(ctx, argv, nil)
+}
 
-	cmd := exec.Command(ZFS_BINARY, args...)
+// runZFSStdin is like runZFS, but additionally pipes stdin to the process,
+// for use by ZFSRecv.
+func runZFSStdin(ctx context.Context, argv []string, stdin io.Reader) ([]byte, error) {
+	tracer().Log(argv)
+	start := time.Now()
 
-	var stdout io.Reader
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+	cmd := exec.CommandContext(ctx, ZFS_BINARY, argv...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Stdin = stdin
 
-	if stdout, err = cmd.StdoutPipe(); err != nil {
-		return
-	}
+	runErr := cmd.Run()
+	dur := time.Since(start)
 
-	if err = cmd.Start(); err != nil {
-		return
+	subcommand := ""
+	if len(argv) > 0 {
+		subcommand = argv[0]
+	}
+	prom.ZFSCommandDuration.WithLabelValues(subcommand).Observe(dur.Seconds())
+	tracer().Observe(argv, dur, runErr)
+
+	if runErr != nil {
+		return nil, ZFSError{
+			Argv:     argv,
+			ExitCode: exitCodeOf(runErr),
+			Stderr:   stderr.Bytes(),
+			WaitErr:  runErr,
+		}
 	}
+	return stdout.Bytes(), nil
+}
 
-	s := bufio.NewScanner(stdout)
-	buf := make([]byte, 1024)
-	s.Buffer(buf, 0)
+// ZFSList is the blocking, buffered counterpart to ZFSListChan, for callers
+// that want the full result set at once instead of streaming it.
+func ZFSList(ctx context.Context, properties []string, zfsArgs ...string) (res [][]string, err error) {
 
-	res = make([][]string, 0)
+	args := make([]string, 0, 4+len(zfsArgs))
+	args = append(args,
+		"list", "-H", "-p",
+		"-o", strings.Join(properties, ","))
+	args = append(args, zfsArgs...)
 
-	for s.Scan() {
-		fields := strings.SplitN(s.Text(), "\t", len(properties))
+	output, err := runZFS(ctx, args)
+	if err != nil {
+		return nil, err
+	}
 
+	lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+	res = make([][]string, 0, len(lines))
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", len(properties))
 		if len(fields) != len(properties) {
-			err = errors.New("unexpected output")
-			return
+			return nil, errors.New("unexpected output")
 		}
-
 		res = append(res, fields)
 	}
+	return res, nil
+}
 
-	if waitErr := cmd.Wait(); waitErr != nil {
-		err := ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: waitErr,
+// zfsStreamCmd is the subset of *rwccmd.Command that newZFSStreamCmd's
+// callers need: a readable, closable handle on the running `zfs` process.
+type zfsStreamCmd interface {
+	io.Reader
+	Close() error
+}
+
+// newZFSStreamCmd starts `zfs argv...` for streaming consumption (ZFSListChan,
+// ZFSDiffChan), logging it via the package's CommandTracer. The returned
+// finish func must be deferred by the caller with a pointer to its own named
+// err so every streaming call site reports duration/tracing/metrics the same
+// way runZFS does for blocking calls, instead of hand-rolling the same
+// Log/timer/prom/Observe sequence at each site.
+func newZFSStreamCmd(ctx context.Context, argv []string) (cmd zfsStreamCmd, finish func(errp *error), err error) {
+	tracer().Log(argv)
+	start := time.Now()
+	finish = func(errp *error) {
+		var observeErr error
+		if errp != nil {
+			observeErr = *errp
 		}
-		return nil, err
+		prom.ZFSCommandDuration.WithLabelValues(subcommandOf(argv)).Observe(time.Since(start).Seconds())
+		tracer().Observe(argv, time.Since(start), observeErr)
 	}
-	return
+
+	c, startErr := rwccmd.CommandContext(ctx, ZFS_BINARY, argv, []string{})
+	if startErr != nil {
+		return nil, finish, ZFSError{Argv: argv, ExitCode: exitCodeOf(startErr), WaitErr: startErr}
+	}
+	if err := c.Start(); err != nil {
+		return nil, finish, ZFSError{Argv: argv, ExitCode: exitCodeOf(err), WaitErr: err}
+	}
+	return c, finish, nil
 }
 
 type ZFSListResult struct {
@@ -219,15 +448,12 @@ func ZFSListChan(ctx context.Context, out chan ZFSListResult, properties []strin
 		}
 	}
 
-	cmd, err := rwccmd.CommandContext(ctx, ZFS_BINARY, args, []string{})
+	cmd, finish, err := newZFSStreamCmd(ctx, args)
+	defer func() { finish(&err) }()
 	if err != nil {
 		sendResult(nil, err)
 		return
 	}
-	if err = cmd.Start(); err != nil {
-		sendResult(nil, err)
-		return
-	}
 	defer cmd.Close()
 
 	s := bufio.NewScanner(cmd)
@@ -237,7 +463,8 @@ func ZFSListChan(ctx context.Context, out chan ZFSListResult, properties []strin
 	for s.Scan() {
 		fields := strings.SplitN(s.Text(), "\t", len(properties))
 		if len(fields) != len(properties) {
-			sendResult(nil, errors.New("unexpected output"))
+			err = errors.New("unexpected output")
+			sendResult(nil, err)
 			return
 		}
 		if sendResult(fields, nil) {
@@ -245,11 +472,22 @@ func ZFSListChan(ctx context.Context, out chan ZFSListResult, properties []strin
 		}
 	}
 	if s.Err() != nil {
-		sendResult(nil, s.Err())
+		err = s.Err()
+		sendResult(nil, err)
 	}
 	return
 }
 
+// observeZFSStreamStartFailure records a streaming invocation (ZFSSend,
+// ZFSSendResume, ZFSRecvWriter) that failed before a single byte was
+// transferred, so Log/Observe stay paired even though these call sites, built
+// on the util package rather than runZFS, never get an observingReader or
+// observingWriteCloser wrapped around a live stream to do so on their behalf.
+func observeZFSStreamStartFailure(argv []string, err error) {
+	prom.ZFSCommandDuration.WithLabelValues(subcommandOf(argv)).Observe(0)
+	tracer().Observe(argv, 0, err)
+}
+
 func ZFSSend(fs *DatasetPath, from, to *FilesystemVersion) (stream io.Reader, err error) {
 
 	args := make([]string, 0)
@@ -261,68 +499,72 @@ func ZFSSend(fs *DatasetPath, from, to *FilesystemVersion) (stream io.Reader, er
 		args = append(args, "-i", from.ToAbsPath(fs), to.ToAbsPath(fs))
 	}
 
+	tracer().Log(args)
 	stream, err = util.RunIOCommand(ZFS_BINARY, args...)
+	if err != nil {
+		observeZFSStreamStartFailure(args, err)
+		return
+	}
+	stream = newObservingReader(stream, args)
 
 	return
 }
 
-func ZFSRecv(fs *DatasetPath, stream io.Reader, additionalArgs ...string) (err error) {
+// ZFSSendResume resumes a send that was previously interrupted, using the
+// resume token reported by the receive side's `receive_resume_token`
+// property (see ZFSGetReceiveResumeToken).
+func ZFSSendResume(token string) (stream io.Reader, err error) {
+	args := []string{"send", "-t", token}
+	tracer().Log(args)
+	stream, err = util.RunIOCommand(ZFS_BINARY, args...)
+	if err != nil {
+		observeZFSStreamStartFailure(args, err)
+		return
+	}
+	stream = newObservingReader(stream, args)
+	return
+}
+
+func ZFSRecv(ctx context.Context, fs *DatasetPath, stream io.Reader, additionalArgs ...string) (err error) {
 
 	args := make([]string, 0)
-	args = append(args, "recv")
-	if len(args) > 0 {
+	args = append(args, "recv", "-s")
+	if len(additionalArgs) > 0 {
 		args = append(args, additionalArgs...)
 	}
 	args = append(args, fs.ToString())
 
-	cmd := exec.Command(ZFS_BINARY, args...)
-
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
-
 	// TODO report bug upstream
-	// Setup an unused stdout buffer.
-	// Otherwise, ZoL v0.6.5.9-1 3.16.0-4-amd64 writes the following error to stderr and exits with code 1
+	// ZoL v0.6.5.9-1 3.16.0-4-amd64 writes the following error to stderr and
+	// exits with code 1 if stdout is not consumed:
 	//   cannot receive new filesystem stream: invalid backup stream
-	stdout := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stdout = stdout
-
-	cmd.Stdin = stream
-
-	if err = cmd.Start(); err != nil {
-		return
-	}
-
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
-		return
-	}
-
-	return nil
+	// runZFSStdin always captures stdout into a buffer, which works around this.
+	_, err = runZFSStdin(ctx, args, stream)
+	return
 }
 
 func ZFSRecvWriter(fs *DatasetPath, additionalArgs ...string) (io.WriteCloser, error) {
 
 	args := make([]string, 0)
-	args = append(args, "recv")
-	if len(args) > 0 {
+	args = append(args, "recv", "-s")
+	if len(additionalArgs) > 0 {
 		args = append(args, additionalArgs...)
 	}
 	args = append(args, fs.ToString())
 
+	tracer().Log(args)
 	cmd, err := util.NewIOCommand(ZFS_BINARY, args, 1024)
 	if err != nil {
+		observeZFSStreamStartFailure(args, err)
 		return nil, err
 	}
 
 	if err = cmd.Start(); err != nil {
+		observeZFSStreamStartFailure(args, err)
 		return nil, err
 	}
 
-	return cmd.Stdin, nil
+	return newObservingWriteCloser(cmd.Stdin, args), nil
 }
 
 type ZFSProperties struct {
@@ -347,7 +589,7 @@ func (p *ZFSProperties) appendArgs(args *[]string) (err error) {
 	return nil
 }
 
-func ZFSSet(fs *DatasetPath, props *ZFSProperties) (err error) {
+func ZFSSet(ctx context.Context, fs *DatasetPath, props *ZFSProperties) (err error) {
 
 	args := make([]string, 0)
 	args = append(args, "set")
@@ -357,30 +599,35 @@ func ZFSSet(fs *DatasetPath, props *ZFSProperties) (err error) {
 	}
 	args = append(args, fs.ToString())
 
-	cmd := exec.Command(ZFS_BINARY, args...)
-
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+	_, err = runZFS(ctx, args)
+	return
+}
 
-	if err = cmd.Start(); err != nil {
-		return err
-	}
+// DatasetProperties is a typed view of `zfs get` output, keyed by property
+// name. Unlike ZFSProperties (used for ZFSSet), its getters parse numeric
+// properties and treat "-" as absent, mirroring the Dataset struct above.
+type DatasetProperties struct {
+	m map[string]string
+}
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
-	}
+// Get returns the raw string value of prop, or "" if prop was not requested
+// or ZFS reported it as "-".
+func (p *DatasetProperties) Get(prop string) string {
+	return parseDatasetString(p.m[prop])
+}
 
-	return
+// GetUint64 returns the value of prop parsed as an unsigned integer, treating
+// "-" as zero.
+func (p *DatasetProperties) GetUint64(prop string) (uint64, error) {
+	return parseDatasetUint64(p.m[prop])
 }
 
-func ZFSGet(fs *DatasetPath, props []string) (*ZFSProperties, error) {
+// ZFSGet returns the given properties of fs as a typed DatasetProperties.
+func ZFSGet(ctx context.Context, fs *DatasetPath, props []string) (*DatasetProperties, error) {
 	args := []string{"get", "-Hp", "-o", "property,value", strings.Join(props, ","), fs.ToString()}
 
-	cmd := exec.Command(ZFS_BINARY, args...)
-	output, err := cmd.CombinedOutput()
+	output, err := runZFS(ctx, args)
+	output = bytes.TrimSuffix(output, []byte("\n"))
 	if err != nil {
 		return nil, err
 	}
@@ -389,7 +636,7 @@ func ZFSGet(fs *DatasetPath, props []string) (*ZFSProperties, error) {
 	if len(lines) != len(props) {
 		return nil, fmt.Errorf("zfs get did not return the number of expected property values")
 	}
-	res := &ZFSProperties{
+	res := &DatasetProperties{
 		make(map[string]string, len(lines)),
 	}
 	for _, line := range lines {
@@ -402,28 +649,85 @@ func ZFSGet(fs *DatasetPath, props []string) (*ZFSProperties, error) {
 	return res, nil
 }
 
-func ZFSDestroy(dataset string) (err error) {
+// ZFSGetReceiveResumeToken returns the `receive_resume_token` property of fs,
+// or the empty string if fs has no partially received stream.
+func ZFSGetReceiveResumeToken(ctx context.Context, fs *DatasetPath) (string, error) {
+	props, err := ZFSGet(ctx, fs, []string{"receive_resume_token"})
+	if err != nil {
+		return "", err
+	}
+	return props.Get("receive_resume_token"), nil
+}
+
+// DestroyFlag is a bitmask of the `zfs destroy` flags relevant to zrepl.
+type DestroyFlag uint32
 
-	cmd := exec.Command(ZFS_BINARY, "destroy", dataset)
+const (
+	DestroyDefault DestroyFlag = 0
 
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+	// DestroyRecursive destroys all descendent datasets (`-r`).
+	DestroyRecursive DestroyFlag = 1 << iota
 
-	if err = cmd.Start(); err != nil {
-		return err
-	}
+	// DestroyRecursiveClones destroys all dependent clones, recursively (`-R`).
+	DestroyRecursiveClones
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
+	// DestroyDeferDeletion defers destruction of a snapshot that still has
+	// holds or clones until it becomes otherwise eligible (`-d`).
+	DestroyDeferDeletion
+
+	// DestroyForceUnmount forcibly unmounts filesystems before destroying
+	// them (`-f`).
+	DestroyForceUnmount
+
+	// DestroyDryRun performs a dry run without actually destroying anything
+	// (`-n`).
+	DestroyDryRun
+)
+
+func (f DestroyFlag) args() []string {
+	args := make([]string, 0, 5)
+	if f&DestroyRecursive != 0 {
+		args = append(args, "-r")
 	}
+	if f&DestroyRecursiveClones != 0 {
+		args = append(args, "-R")
+	}
+	if f&DestroyDeferDeletion != 0 {
+		args = append(args, "-d")
+	}
+	if f&DestroyForceUnmount != 0 {
+		args = append(args, "-f")
+	}
+	if f&DestroyDryRun != 0 {
+		args = append(args, "-n")
+	}
+	return args
+}
+
+func ZFSDestroy(ctx context.Context, dataset string, flags DestroyFlag) (err error) {
 
+	args := append([]string{"destroy"}, flags.args()...)
+	args = append(args, dataset)
+
+	_, err = runZFS(ctx, args)
 	return
 
 }
 
+// ZFSDestroyFilesystemVersions destroys the given snapshots of fs in a single
+// `zfs destroy fs@a,b,c` invocation instead of one fork/exec per snapshot.
+func ZFSDestroyFilesystemVersions(ctx context.Context, fs *DatasetPath, versions []*FilesystemVersion, flags DestroyFlag) (err error) {
+	if len(versions) == 0 {
+		return nil
+	}
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = v.Name
+	}
+	dataset := fmt.Sprintf("%s@%s", fs.ToString(), strings.Join(names, ","))
+	return ZFSDestroy(ctx, dataset, flags)
+}
+
 func zfsBuildSnapName(fs *DatasetPath, name string) string { // TODO defensive
 	return fmt.Sprintf("%s@%s", fs.ToString(), name)
 }
@@ -432,33 +736,243 @@ func zfsBuildBookmarkName(fs *DatasetPath, name string) string { // TODO defensi
 	return fmt.Sprintf("%s#%s", fs.ToString(), name)
 }
 
-func ZFSSnapshot(fs *DatasetPath, name string, recursive bool) (err error) {
+func ZFSSnapshot(ctx context.Context, fs *DatasetPath, name string, recursive bool) (err error) {
 
 	promTimer := prometheus.NewTimer(prom.ZFSSnapshotDuration.WithLabelValues(fs.ToString()))
 	defer promTimer.ObserveDuration()
 
 	snapname := zfsBuildSnapName(fs, name)
-	cmd := exec.Command(ZFS_BINARY, "snapshot", snapname)
+	args := []string{"snapshot"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, snapname)
 
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+	_, err = runZFS(ctx, args)
+	return
 
-	if err = cmd.Start(); err != nil {
-		return err
+}
+
+// ChangeType is the kind of change a line of `zfs diff` output describes.
+type ChangeType int
+
+const (
+	ChangeTypeRemoved ChangeType = iota
+	ChangeTypeCreated
+	ChangeTypeModified
+	ChangeTypeRenamed
+)
+
+func decodeChangeType(s string) (ChangeType, error) {
+	switch s {
+	case "-":
+		return ChangeTypeRemoved, nil
+	case "+":
+		return ChangeTypeCreated, nil
+	case "M":
+		return ChangeTypeModified, nil
+	case "R":
+		return ChangeTypeRenamed, nil
+	}
+	return 0, fmt.Errorf("unknown zfs diff change type %q", s)
+}
+
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeTypeRemoved:
+		return "removed"
+	case ChangeTypeCreated:
+		return "created"
+	case ChangeTypeModified:
+		return "modified"
+	case ChangeTypeRenamed:
+		return "renamed"
 	}
+	return "unknown"
+}
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
+// InodeType is the type of filesystem object a DiffEntry refers to, as
+// reported by the inode type column of `zfs diff -F`.
+type InodeType int
+
+const (
+	BlockDevice InodeType = iota + 1
+	CharacterDevice
+	Directory
+	Door
+	NamedPipe
+	SymbolicLink
+	EventPort
+	Socket
+	File
+)
+
+func decodeInodeType(s string) (InodeType, error) {
+	switch s {
+	case "B":
+		return BlockDevice, nil
+	case "C":
+		return CharacterDevice, nil
+	case "/":
+		return Directory, nil
+	case ">":
+		return Door, nil
+	case "|":
+		return NamedPipe, nil
+	case "@":
+		return SymbolicLink, nil
+	case "P":
+		return EventPort, nil
+	case "=":
+		return Socket, nil
+	case "F":
+		return File, nil
+	}
+	return 0, fmt.Errorf("unknown zfs diff inode type %q", s)
+}
+
+// DiffEntry is a single line of `zfs diff -FHt` output, parsed into typed
+// fields. NewPath is only set if Change == ChangeTypeRenamed.
+type DiffEntry struct {
+	Timestamp time.Time
+	Change    ChangeType
+	Inode     InodeType
+	Path      string
+	NewPath   string
+}
+
+// unescapeZFSDiffPath reverses the octal backslash-escaping `zfs diff` applies
+// to paths containing whitespace or other special characters (e.g. a tab
+// becomes `\011`).
+func unescapeZFSDiffPath(s string) string {
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
 		}
+		b.WriteByte(s[i])
 	}
+	return b.String()
+}
 
-	return
+func parseZFSDiffLine(line string) (DiffEntry, error) {
+	fields := strings.SplitN(line, "\t", 5)
+	if len(fields) < 4 {
+		return DiffEntry{}, fmt.Errorf("unexpected zfs diff line: %q", line)
+	}
+
+	tsFloat, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return DiffEntry{}, fmt.Errorf("cannot parse zfs diff timestamp: %s", err)
+	}
+	sec := int64(tsFloat)
+	nsec := int64((tsFloat - float64(sec)) * 1e9)
+
+	change, err := decodeChangeType(fields[1])
+	if err != nil {
+		return DiffEntry{}, err
+	}
+	inode, err := decodeInodeType(fields[2])
+	if err != nil {
+		return DiffEntry{}, err
+	}
+
+	entry := DiffEntry{
+		Timestamp: time.Unix(sec, nsec),
+		Change:    change,
+		Inode:     inode,
+		Path:      unescapeZFSDiffPath(fields[3]),
+	}
+	if change == ChangeTypeRenamed {
+		if len(fields) < 5 {
+			return DiffEntry{}, fmt.Errorf("zfs diff rename entry without new path: %q", line)
+		}
+		entry.NewPath = unescapeZFSDiffPath(fields[4])
+	}
+	return entry, nil
+}
+
+// DiffResult is the element type sent on the channel passed to ZFSDiffChan.
+type DiffResult struct {
+	Entry DiffEntry
+	Err   error
+}
+
+// ZFSDiff returns the changes between the from and to snapshots of fs as
+// reported by `zfs diff`.
+func ZFSDiff(fs *DatasetPath, from, to *FilesystemVersion) ([]DiffEntry, error) {
+	ch := make(chan DiffResult)
+	go ZFSDiffChan(context.Background(), ch, fs, from, to)
+	entries := make([]DiffEntry, 0)
+	for res := range ch {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		entries = append(entries, res.Entry)
+	}
+	return entries, nil
+}
+
+// ZFSDiffChan is the streaming variant of ZFSDiff. The out channel is always
+// closed by ZFSDiffChan, following the same semantics as ZFSListChan.
+func ZFSDiffChan(ctx context.Context, out chan DiffResult, fs *DatasetPath, from, to *FilesystemVersion) {
+	defer close(out)
+
+	promTimer := prometheus.NewTimer(prom.ZFSDiffDuration.WithLabelValues(fs.ToString()))
+	defer promTimer.ObserveDuration()
 
+	args := []string{"diff", "-FHt", from.ToAbsPath(fs)}
+	if to != nil {
+		args = append(args, to.ToAbsPath(fs))
+	}
+
+	sendResult := func(res DiffResult) (done bool) {
+		select {
+		case <-ctx.Done():
+			return true
+		case out <- res:
+			return false
+		}
+	}
+
+	cmd, finish, err := newZFSStreamCmd(ctx, args)
+	defer func() { finish(&err) }()
+	if err != nil {
+		sendResult(DiffResult{Err: err})
+		return
+	}
+	defer cmd.Close()
+
+	count := 0
+	s := bufio.NewScanner(cmd)
+	buf := make([]byte, 1024)
+	s.Buffer(buf, 0)
+	for s.Scan() {
+		var entry DiffEntry
+		entry, err = parseZFSDiffLine(s.Text())
+		if err != nil {
+			sendResult(DiffResult{Err: err})
+			return
+		}
+		count++
+		if sendResult(DiffResult{Entry: entry}) {
+			return
+		}
+	}
+	prom.ZFSDiffChangeCount.WithLabelValues(fs.ToString()).Observe(float64(count))
+	if err = s.Err(); err != nil {
+		sendResult(DiffResult{Err: err})
+	}
 }
 
-func ZFSBookmark(fs *DatasetPath, snapshot, bookmark string) (err error) {
+func ZFSBookmark(ctx context.Context, fs *DatasetPath, snapshot, bookmark string) (err error) {
 
 	promTimer := prometheus.NewTimer(prom.ZFSBookmarkDuration.WithLabelValues(fs.ToString()))
 	defer promTimer.ObserveDuration()
@@ -466,22 +980,127 @@ func ZFSBookmark(fs *DatasetPath, snapshot, bookmark string) (err error) {
 	snapname := zfsBuildSnapName(fs, snapshot)
 	bookmarkname := zfsBuildBookmarkName(fs, bookmark)
 
-	cmd := exec.Command(ZFS_BINARY, "bookmark", snapname, bookmarkname)
+	_, err = runZFS(ctx, []string{"bookmark", snapname, bookmarkname})
+	return
 
-	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
-	cmd.Stderr = stderr
+}
 
-	if err = cmd.Start(); err != nil {
-		return err
+// Hold is a single `zfs holds` entry on a snapshot.
+type Hold struct {
+	Tag       string
+	Timestamp time.Time
+}
+
+// zreplHoldTagPrefix is the prefix zrepl uses for all hold tags it places, so
+// that orphaned holds can be recognized and reaped independently of which
+// zrepl subsystem (or job) created them.
+const zreplHoldTagPrefix = "zrepl_"
+
+// SendHoldTag returns the hold tag zrepl places on the `from` and `to`
+// snapshots of an in-flight send for job jobID.
+func SendHoldTag(jobID string) string {
+	return fmt.Sprintf("%ssend_%s", zreplHoldTagPrefix, jobID)
+}
+
+// RecvHoldTag returns the hold tag zrepl places on a snapshot that has just
+// been received for job jobID, until its feed-forward to the next step is
+// confirmed.
+func RecvHoldTag(jobID string) string {
+	return fmt.Sprintf("%srecv_%s", zreplHoldTagPrefix, jobID)
+}
+
+// IsZreplHoldTag reports whether tag was placed by zrepl (as opposed to some
+// other user of `zfs hold`).
+func IsZreplHoldTag(tag string) bool {
+	return strings.HasPrefix(tag, zreplHoldTagPrefix)
+}
+
+// ZFSHold places a hold with the given tag on fs@snapshot, preventing it from
+// being destroyed until the hold is released with ZFSRelease.
+func ZFSHold(ctx context.Context, fs *DatasetPath, snapshot, tag string, recursive bool) (err error) {
+	snapname := zfsBuildSnapName(fs, snapshot)
+
+	args := make([]string, 0, 4)
+	args = append(args, "hold")
+	if recursive {
+		args = append(args, "-r")
 	}
+	args = append(args, tag, snapname)
 
-	if err = cmd.Wait(); err != nil {
-		err = ZFSError{
-			Stderr:  stderr.Bytes(),
-			WaitErr: err,
-		}
+	_, err = runZFS(ctx, args)
+	return
+}
+
+// ZFSRelease releases the hold with the given tag from fs@snapshot.
+func ZFSRelease(ctx context.Context, fs *DatasetPath, snapshot, tag string, recursive bool) (err error) {
+	snapname := zfsBuildSnapName(fs, snapshot)
+
+	args := make([]string, 0, 4)
+	args = append(args, "release")
+	if recursive {
+		args = append(args, "-r")
 	}
+	args = append(args, tag, snapname)
 
+	_, err = runZFS(ctx, args)
 	return
+}
+
+// zfsHoldsTimestampLayout matches the TIMESTAMP column `zfs holds -H` prints
+// (zfs has no -p/parsable-timestamp mode for holds), e.g. "Wed Jun  5 12:00 2024".
+const zfsHoldsTimestampLayout = "Mon Jan _2 15:04 2006"
 
+// ZFSHolds returns the holds currently placed on fs@snapshot.
+func ZFSHolds(ctx context.Context, fs *DatasetPath, snapshot string) ([]Hold, error) {
+	snapname := zfsBuildSnapName(fs, snapshot)
+
+	output, err := runZFS(ctx, []string{"holds", "-H", snapname})
+	if err != nil {
+		return nil, err
+	}
+
+	holds := make([]Hold, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("zfs holds: unexpected line %q", line)
+		}
+		ts, err := time.Parse(zfsHoldsTimestampLayout, strings.TrimSpace(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("zfs holds: cannot parse timestamp: %s", err)
+		}
+		holds = append(holds, Hold{
+			Tag:       fields[1],
+			Timestamp: ts,
+		})
+	}
+	return holds, nil
+}
+
+// ReapOrphanedHolds releases every zrepl-placed hold on snapshot whose tag
+// does not belong to one of knownJobIDs. It is meant to be run on startup, so
+// that holds left behind by a job that was removed from the config (or
+// renamed) don't pin snapshots forever.
+func ReapOrphanedHolds(ctx context.Context, fs *DatasetPath, snapshot string, knownJobIDs map[string]bool) error {
+	holds, err := ZFSHolds(ctx, fs, snapshot)
+	if err != nil {
+		return err
+	}
+	for _, h := range holds {
+		if !IsZreplHoldTag(h.Tag) {
+			continue
+		}
+		jobID := strings.TrimPrefix(h.Tag, zreplHoldTagPrefix)
+		jobID = strings.TrimPrefix(strings.TrimPrefix(jobID, "send_"), "recv_")
+		if knownJobIDs[jobID] {
+			continue
+		}
+		if err := ZFSRelease(ctx, fs, snapshot, h.Tag, false); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,139 @@
+package zfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeZFSSendResumeScript is a stand-in `zfs` binary that simulates a `zfs
+// send` interrupted partway through: the first invocation writes a partial
+// stream and exits non-zero, and any subsequent `zfs send -t <token>`
+// invocation succeeds and writes the full stream.
+const fakeZFSSendResumeScript = `#!/bin/sh
+attempt_file="` + "`dirname \"$0\"`" + `/attempt"
+if [ "$1" = "send" ] && [ "$2" = "-t" ]; then
+  printf 'resumed-payload'
+  exit 0
+fi
+if [ "$1" = "send" ]; then
+  if [ -f "$attempt_file" ]; then
+    printf 'full-payload'
+    exit 0
+  fi
+  touch "$attempt_file"
+  printf 'partial'
+  exit 1
+fi
+exit 1
+`
+
+// TestZFSSendResume simulates a zfs send that gets interrupted partway
+// through and verifies that a second attempt, using the resume token
+// reported for the partial receive, completes the stream via ZFSSendResume.
+func TestZFSSendResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zrepl-zfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "zfs")
+	if err := ioutil.WriteFile(script, []byte(fakeZFSSendResumeScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBinary := ZFS_BINARY
+	ZFS_BINARY = script
+	defer func() { ZFS_BINARY = oldBinary }()
+
+	fs, err := NewDatasetPath("pool/fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := &FilesystemVersion{Name: "a"}
+
+	// First attempt: the stream is truncated, simulating a connection drop
+	// mid-send.
+	stream, err := ZFSSend(fs, from, nil)
+	if err != nil {
+		t.Fatalf("first send attempt: unexpected error starting send: %s", err)
+	}
+	partial, _ := ioutil.ReadAll(stream)
+	if string(partial) != "partial" {
+		t.Fatalf("expected truncated first attempt, got %q", partial)
+	}
+
+	// Second attempt: resume using the token the receive side would have
+	// reported via ZFSGetReceiveResumeToken.
+	resumed, err := ZFSSendResume("some-resume-token")
+	if err != nil {
+		t.Fatalf("resume attempt: unexpected error: %s", err)
+	}
+	full, err := ioutil.ReadAll(resumed)
+	if err != nil {
+		t.Fatalf("resume attempt: unexpected error reading stream: %s", err)
+	}
+	if string(full) != "resumed-payload" {
+		t.Fatalf("expected resumed stream to complete via token path, got %q", full)
+	}
+}
+
+// fakeZFSHoldsScript is a stand-in `zfs` binary that answers `zfs holds -H`
+// with real-world output: a human-readable TIMESTAMP column, not a Unix
+// epoch, since `zfs holds` has no parsable-timestamp mode.
+const fakeZFSHoldsScript = `#!/bin/sh
+if [ "$1" = "holds" ]; then
+  printf 'pool/fs@snap\ttag1\tWed Jun  5 12:00 2024\n'
+  printf 'pool/fs@snap\ttag2\tThu Jan  2 03:04 2025\n'
+  exit 0
+fi
+exit 1
+`
+
+// TestZFSHolds verifies that ZFSHolds can parse the human-readable timestamp
+// format of real `zfs holds -H` output.
+func TestZFSHolds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zrepl-zfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "zfs")
+	if err := ioutil.WriteFile(script, []byte(fakeZFSHoldsScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBinary := ZFS_BINARY
+	ZFS_BINARY = script
+	defer func() { ZFS_BINARY = oldBinary }()
+
+	fs, err := NewDatasetPath("pool/fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holds, err := ZFSHolds(context.Background(), fs, "snap")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(holds) != 2 {
+		t.Fatalf("expected 2 holds, got %d", len(holds))
+	}
+	if holds[0].Tag != "tag1" {
+		t.Errorf("expected tag1, got %q", holds[0].Tag)
+	}
+	if !holds[0].Timestamp.Equal(time.Date(2024, time.June, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected timestamp for tag1: %s", holds[0].Timestamp)
+	}
+	if holds[1].Tag != "tag2" {
+		t.Errorf("expected tag2, got %q", holds[1].Tag)
+	}
+	if !holds[1].Timestamp.Equal(time.Date(2025, time.January, 2, 3, 4, 0, 0, time.UTC)) {
+		t.Errorf("unexpected timestamp for tag2: %s", holds[1].Timestamp)
+	}
+}